@@ -0,0 +1,103 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+// Package daemon provides a simple way to install/remove/start/stop a
+// Windows service as well as drive its run loop. Windows is the only
+// platform with an implementation.
+package daemon
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	success = "\t\t\t\t\t[  OK  ]"
+	failed  = "\t\t\t\t\t[FAILED]"
+)
+
+// Errors returned by the Daemon implementations.
+var (
+	// ErrAlreadyRunning is returned by Install when the service is
+	// already installed
+	ErrAlreadyRunning = errors.New("service has already been installed")
+	// ErrAlreadyStopped appears if daemon is stopped
+	ErrAlreadyStopped = errors.New("service has already been stopped")
+	// ErrNotInstalled appears if daemon is not installed
+	ErrNotInstalled = errors.New("service is not installed")
+)
+
+// Daemon provides the interface to control and query the current service
+// running on the platform's service manager (or equivalent).
+type Daemon interface {
+	// Install the service into the system manager, passing args to it on
+	// every subsequent start
+	Install(args ...string) (string, error)
+
+	// InstallWithOptions installs the service the same way Install does,
+	// but lets the caller configure the log-on account, start type and
+	// privileges instead of accepting the platform defaults
+	InstallWithOptions(opts InstallOptions, args ...string) (string, error)
+
+	// SetRecoveryPolicy reconfigures what the service manager does when
+	// the installed service's process terminates unexpectedly
+	SetRecoveryPolicy(policy RecoveryPolicy) error
+
+	// SetStopTimeout overrides how long Stop waits for the service to
+	// reach the requested state before giving up
+	SetStopTimeout(timeout time.Duration)
+
+	// SetPreShutdownTimeout sets how long the service manager waits after
+	// the pre-shutdown notification before the normal shutdown proceeds,
+	// and bounds the Executable's optional pre-shutdown hook when Run is
+	// called on the same Daemon
+	SetPreShutdownTimeout(timeout time.Duration) error
+
+	// Diagnose walks the installed service's dependency chain and reports
+	// each dependency's current status, to help explain why a service
+	// failed to start when a transitive dependency is stopped or disabled
+	Diagnose() (*DependencyNode, error)
+
+	// Remove the service from the system manager
+	Remove() (string, error)
+
+	// Start the installed service
+	Start() (string, error)
+
+	// Stop the installed service
+	Stop() (string, error)
+
+	// Status reports the current status of the installed service
+	Status() (string, error)
+
+	// Run drives the Executable's lifecycle: under the platform's service
+	// manager when running as a service, or directly when running
+	// interactively
+	Run(e Executable) (string, error)
+
+	// GetTemplate gets the service config template
+	GetTemplate() string
+
+	// SetTemplate sets the service config template
+	SetTemplate(tplStr string) error
+}
+
+// Executable defines the lifecycle hooks a caller implements to have its
+// code driven by the Daemon: Start is called once before the run loop
+// begins, Run is called to perform the actual work, and Stop is called
+// when the service is asked to shut down. Under the service manager Run
+// is called before control requests are handled, so Stop is only
+// delivered after Run returns; in an interactive session Run runs on its
+// own goroutine and may block.
+type Executable interface {
+	Start()
+	Stop()
+	Run()
+}
+
+// New creates a new Daemon instance for the given name and description.
+// Any extra arguments are treated as service dependencies.
+func New(name, description string, dependencies ...string) (Daemon, error) {
+	return newDaemon(name, description, dependencies)
+}
@@ -6,15 +6,20 @@
 package daemon
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
+	"unicode/utf16"
+	"unsafe"
 
+	winapi "golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -23,11 +28,62 @@ import (
 
 var elog debug.Log
 
+// defaultStopTimeout is how long Stop waits for the SCM to report that the
+// service has reached the target state before giving up.
+const defaultStopTimeout = 10 * time.Second
+
 // windowsRecord - standard record (struct) for windows version of daemon package
 type windowsRecord struct {
 	name         string
 	description  string
 	dependencies []string
+	// stopTimeout bounds how long Stop waits for the service to report
+	// svc.Stopped. Zero is treated as defaultStopTimeout.
+	stopTimeout time.Duration
+	// preShutdownTimeout is the value last applied to the service's
+	// SERVICE_PRESHUTDOWN_INFO by SetPreShutdownTimeout, and is used to
+	// bound the optional PreShutdowner.PreShutdown hook at run time. Zero
+	// bounds the hook by defaultStopTimeout instead.
+	preShutdownTimeout time.Duration
+}
+
+// PreShutdowner is implemented by an Executable that wants a chance to
+// flush state before the SCM kills its process, in addition to the normal
+// Stop notification. Run detects it with a type assertion, so existing
+// Executables that only implement Start/Stop/Run keep working unchanged.
+type PreShutdowner interface {
+	PreShutdown(ctx context.Context)
+}
+
+// InstallOptions controls how Install registers the service with the SCM:
+// which account it logs on as, how it is started, and which privileges/SID
+// type it is granted. The zero value installs the service the way Install
+// always used to: LocalSystem, automatic start, no delayed auto-start,
+// default SID type.
+type InstallOptions struct {
+	// UserName is the account the service logs on as, e.g.
+	// "NT AUTHORITY\\LocalService", "NT AUTHORITY\\NetworkService" or a
+	// domain\user. Empty means LocalSystem.
+	UserName string
+	// Password is the account password. Ignored for the built-in service
+	// accounts, which don't take one.
+	Password string
+	// StartType is one of mgr.StartAutomatic, mgr.StartManual or
+	// mgr.StartDisabled. Zero defaults to mgr.StartAutomatic.
+	StartType uint32
+	// DelayedAutoStart requests SERVICE_DELAYED_AUTO_START. Only
+	// meaningful when StartType is mgr.StartAutomatic.
+	DelayedAutoStart bool
+	// SidType is one of winapi.SERVICE_SID_TYPE_NONE,
+	// winapi.SERVICE_SID_TYPE_RESTRICTED or
+	// winapi.SERVICE_SID_TYPE_UNRESTRICTED. Zero leaves the SCM default
+	// (none) in place.
+	SidType uint32
+	// RequiredPrivileges lists the privilege names (e.g.
+	// "SeBackupPrivilege") the service's token is allowed to keep; the SCM
+	// strips everything else. Empty leaves the service's privileges
+	// unrestricted.
+	RequiredPrivileges []string
 }
 
 func newDaemon(name, description string, dependencies []string) (Daemon, error) {
@@ -36,11 +92,25 @@ func newDaemon(name, description string, dependencies []string) (Daemon, error)
 	if err != nil {
 		elog = nil
 	}
-	return &windowsRecord{name, description, dependencies}, nil
+	return &windowsRecord{
+		name:         name,
+		description:  description,
+		dependencies: dependencies,
+		stopTimeout:  defaultStopTimeout,
+	}, nil
 }
 
-// Install the service
+// Install the service using the zero-value InstallOptions: LocalSystem,
+// automatic start, default SID type, unrestricted privileges.
 func (windows *windowsRecord) Install(args ...string) (string, error) {
+	return windows.InstallWithOptions(InstallOptions{}, args...)
+}
+
+// InstallWithOptions installs the service the same way Install does, but
+// lets the caller pick the log-on account, start type, delayed auto-start,
+// SID type and required privileges instead of accepting the hardcoded
+// LocalSystem/automatic-start defaults.
+func (windows *windowsRecord) InstallWithOptions(opts InstallOptions, args ...string) (string, error) {
 	installAction := "Install " + windows.description + ":"
 
 	execp, err := execPath()
@@ -61,40 +131,37 @@ func (windows *windowsRecord) Install(args ...string) (string, error) {
 		return installAction, ErrAlreadyRunning
 	}
 
+	startType := opts.StartType
+	if startType == 0 {
+		startType = mgr.StartAutomatic
+	}
+
 	s, err = m.CreateService(windows.name, execp, mgr.Config{
-		DisplayName:  windows.name,
-		Description:  windows.description,
-		StartType:    mgr.StartAutomatic,
-		Dependencies: windows.dependencies,
+		DisplayName:      windows.name,
+		Description:      windows.description,
+		StartType:        startType,
+		Dependencies:     windows.dependencies,
+		ServiceStartName: opts.UserName,
+		Password:         opts.Password,
+		DelayedAutoStart: opts.DelayedAutoStart,
+		SidType:          opts.SidType,
 	}, args...)
 	if err != nil {
 		return installAction, err
 	}
 	defer s.Close()
 
-	// set recovery action for service
-	// restart after 5 seconds for the first 3 times
-	// restart after 1 minute, otherwise
-	r := []mgr.RecoveryAction{
-		mgr.RecoveryAction{
-			Type:  mgr.ServiceRestart,
-			Delay: 5000 * time.Millisecond,
-		},
-		mgr.RecoveryAction{
-			Type:  mgr.ServiceRestart,
-			Delay: 5000 * time.Millisecond,
-		},
-		mgr.RecoveryAction{
-			Type:  mgr.ServiceRestart,
-			Delay: 5000 * time.Millisecond,
-		},
-		mgr.RecoveryAction{
-			Type:  mgr.ServiceRestart,
-			Delay: 60000 * time.Millisecond,
-		},
+	if len(opts.RequiredPrivileges) > 0 {
+		if err = setRequiredPrivileges(s.Handle, opts.RequiredPrivileges); err != nil {
+			s.Delete()
+			return installAction, err
+		}
+	}
+
+	if err = applyRecoveryPolicy(s, DefaultRecoveryPolicy()); err != nil {
+		s.Delete()
+		return installAction, err
 	}
-	// set reset period as a day
-	s.SetRecoveryActions(r, uint32(86400))
 
 	err = eventlog.InstallAsEventCreate(windows.name, eventlog.Error|eventlog.Warning|eventlog.Info)
 	if err != nil {
@@ -104,6 +171,99 @@ func (windows *windowsRecord) Install(args ...string) (string, error) {
 	return installAction + " completed.", nil
 }
 
+// serviceRequiredPrivilegesInfo mirrors the Win32 SERVICE_REQUIRED_PRIVILEGES_INFOW
+// struct, which x/sys/windows exposes the SERVICE_CONFIG_REQUIRED_PRIVILEGES_INFO
+// level constant for but not the info struct itself.
+type serviceRequiredPrivilegesInfo struct {
+	RequiredPrivileges *uint16
+}
+
+// setRequiredPrivileges restricts the service's token to exactly the named
+// privileges via SERVICE_CONFIG_REQUIRED_PRIVILEGES_INFO. The privilege
+// list is passed to the SCM as a double-null-terminated multi-string.
+func setRequiredPrivileges(h winapi.Handle, privileges []string) error {
+	var buf []uint16
+	for _, p := range privileges {
+		buf = append(buf, utf16.Encode([]rune(p))...)
+		buf = append(buf, 0)
+	}
+	buf = append(buf, 0)
+
+	info := serviceRequiredPrivilegesInfo{
+		RequiredPrivileges: &buf[0],
+	}
+	return winapi.ChangeServiceConfig2(h, winapi.SERVICE_CONFIG_REQUIRED_PRIVILEGES_INFO, (*byte)(unsafe.Pointer(&info)))
+}
+
+// RecoveryPolicy describes what the SCM should do when the service's
+// process terminates unexpectedly: which action to take per failed
+// attempt, how long to wait before taking it, how long the service has to
+// stay up before the failure count resets, and what to show/run for the
+// RunCommand/ComputerReboot actions.
+type RecoveryPolicy struct {
+	// Actions are applied in order, one per consecutive failure; the last
+	// entry repeats for every failure past the end of the slice.
+	Actions []mgr.RecoveryAction
+	// ResetPeriod is how long the service must run without failing before
+	// the failure count resets to zero.
+	ResetPeriod time.Duration
+	// RebootMessage is broadcast before a mgr.ComputerReboot action. Only
+	// meaningful if Actions contains that action type.
+	RebootMessage string
+	// Command is run for a mgr.RunCommand action. Only meaningful if
+	// Actions contains that action type.
+	Command string
+}
+
+// DefaultRecoveryPolicy is the policy Install has always applied: restart
+// after 5 seconds for the first 3 failures, restart after 1 minute for
+// every failure after that, resetting the count once a day.
+func DefaultRecoveryPolicy() RecoveryPolicy {
+	return RecoveryPolicy{
+		Actions: []mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 5000 * time.Millisecond},
+			{Type: mgr.ServiceRestart, Delay: 5000 * time.Millisecond},
+			{Type: mgr.ServiceRestart, Delay: 5000 * time.Millisecond},
+			{Type: mgr.ServiceRestart, Delay: 60000 * time.Millisecond},
+		},
+		ResetPeriod: 86400 * time.Second,
+	}
+}
+
+// applyRecoveryPolicy pushes policy to an already-open service handle.
+func applyRecoveryPolicy(s *mgr.Service, policy RecoveryPolicy) error {
+	if err := s.SetRecoveryActions(policy.Actions, uint32(policy.ResetPeriod.Seconds())); err != nil {
+		return err
+	}
+	if policy.Command != "" {
+		if err := s.SetRecoveryCommand(policy.Command); err != nil {
+			return err
+		}
+	}
+	if policy.RebootMessage != "" {
+		if err := s.SetRebootMessage(policy.RebootMessage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRecoveryPolicy reconfigures the recovery actions, reset period,
+// reboot message and recovery command of an already-installed service.
+func (windows *windowsRecord) SetRecoveryPolicy(policy RecoveryPolicy) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(windows.name)
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer s.Close()
+	return applyRecoveryPolicy(s, policy)
+}
+
 // Remove the service
 func (windows *windowsRecord) Remove() (string, error) {
 	removeAction := "Removing " + windows.description + ":"
@@ -152,14 +312,57 @@ func (windows *windowsRecord) Start() (string, error) {
 // Stop the service
 func (windows *windowsRecord) Stop() (string, error) {
 	stopAction := "Stopping " + windows.description + ":"
-	err := controlService(windows.name, svc.Stop, svc.Stopped)
+	timeout := windows.stopTimeout
+	if timeout == 0 {
+		timeout = defaultStopTimeout
+	}
+	err := controlService(windows.name, svc.Stop, svc.Stopped, timeout)
 	if err != nil {
 		return stopAction, getWindowsError(err)
 	}
 	return stopAction + " completed.", nil
 }
 
-func controlService(name string, c svc.Cmd, to svc.State) error {
+// SetStopTimeout overrides how long Stop waits for the SCM to report that
+// the service has reached the requested state before giving up.
+func (windows *windowsRecord) SetStopTimeout(timeout time.Duration) {
+	windows.stopTimeout = timeout
+}
+
+// servicePreshutdownInfo mirrors the Win32 SERVICE_PRESHUTDOWN_INFO struct,
+// which x/sys/windows exposes the SERVICE_CONFIG_PRESHUTDOWN_INFO level
+// constant for but not the info struct itself.
+type servicePreshutdownInfo struct {
+	PreshutdownTimeout uint32
+}
+
+// SetPreShutdownTimeout tells the SCM, via SERVICE_PRESHUTDOWN_INFO, how
+// long it should wait after sending the pre-shutdown notification before
+// moving on to the normal shutdown sequence. The same duration bounds the
+// PreShutdowner.PreShutdown hook when Run is later called on this Daemon
+// value. Whether the running service accepts the pre-shutdown
+// notification depends only on its Executable implementing PreShutdowner.
+func (windows *windowsRecord) SetPreShutdownTimeout(timeout time.Duration) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(windows.name)
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer s.Close()
+
+	info := servicePreshutdownInfo{PreshutdownTimeout: uint32(timeout / time.Millisecond)}
+	if err = winapi.ChangeServiceConfig2(s.Handle, winapi.SERVICE_CONFIG_PRESHUTDOWN_INFO, (*byte)(unsafe.Pointer(&info))); err != nil {
+		return getWindowsError(err)
+	}
+	windows.preShutdownTimeout = timeout
+	return nil
+}
+
+func controlService(name string, c svc.Cmd, to svc.State, timeout time.Duration) error {
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
@@ -174,9 +377,9 @@ func controlService(name string, c svc.Cmd, to svc.State) error {
 	if err != nil {
 		return fmt.Errorf("could not send control=%d: %v", c, err)
 	}
-	timeout := time.Now().Add(10 * time.Second)
+	deadline := time.Now().Add(timeout)
 	for status.State != to {
-		if timeout.Before(time.Now()) {
+		if deadline.Before(time.Now()) {
 			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
 		}
 		time.Sleep(300 * time.Millisecond)
@@ -208,6 +411,95 @@ func (windows *windowsRecord) Status() (string, error) {
 	return "Status: " + getWindowsServiceStateFromUint32(status.State), nil
 }
 
+// DependencyNode describes one service in a dependency chain: its current
+// process status plus the chain of services it in turn depends on. It is
+// built by Diagnose and is JSON-serializable so it can be logged or
+// returned from a diagnostics endpoint as-is.
+type DependencyNode struct {
+	Name                    string            `json:"name"`
+	DisplayName             string            `json:"displayName"`
+	StartType               uint32            `json:"startType"`
+	State                   string            `json:"state"`
+	Win32ExitCode           uint32            `json:"win32ExitCode"`
+	ServiceSpecificExitCode uint32            `json:"serviceSpecificExitCode"`
+	CheckPoint              uint32            `json:"checkPoint"`
+	WaitHint                uint32            `json:"waitHint"`
+	ProcessId               uint32            `json:"processId"`
+	Error                   string            `json:"error,omitempty"`
+	Dependencies            []*DependencyNode `json:"dependencies,omitempty"`
+}
+
+// Diagnose walks the installed service's dependency chain and reports each
+// dependency's current status: state, start type, exit codes, checkpoint,
+// wait hint and PID. It's meant to explain why a service failed to start
+// when the real cause is a stopped or disabled transitive dependency,
+// which Status alone can't show.
+func (windows *windowsRecord) Diagnose() (*DependencyNode, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, getWindowsError(err)
+	}
+	defer m.Disconnect()
+	return diagnoseService(m, windows.name, make(map[string]*DependencyNode))
+}
+
+// queryServiceStatusProcess calls QueryServiceStatusEx directly rather than
+// mgr.Service.Query, whose svc.Status conversion drops CheckPoint and
+// WaitHint even though the underlying SERVICE_STATUS_PROCESS carries them.
+func queryServiceStatusProcess(h winapi.Handle) (winapi.SERVICE_STATUS_PROCESS, error) {
+	var status winapi.SERVICE_STATUS_PROCESS
+	var bytesNeeded uint32
+	err := winapi.QueryServiceStatusEx(h, winapi.SC_STATUS_PROCESS_INFO, (*byte)(unsafe.Pointer(&status)), uint32(unsafe.Sizeof(status)), &bytesNeeded)
+	return status, err
+}
+
+// diagnoseService fills in the DependencyNode for name and recurses into
+// its dependencies, using visited to short-circuit services already seen
+// so a dependency cycle can't cause infinite recursion.
+func diagnoseService(m *mgr.Mgr, name string, visited map[string]*DependencyNode) (*DependencyNode, error) {
+	if node, ok := visited[name]; ok {
+		return node, nil
+	}
+	node := &DependencyNode{Name: name}
+	visited[name] = node
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		node.Error = err.Error()
+		return node, nil
+	}
+	defer s.Close()
+
+	cfg, err := s.Config()
+	if err != nil {
+		node.Error = err.Error()
+		return node, nil
+	}
+	node.DisplayName = cfg.DisplayName
+	node.StartType = cfg.StartType
+
+	status, err := queryServiceStatusProcess(s.Handle)
+	if err != nil {
+		node.Error = err.Error()
+		return node, nil
+	}
+	node.State = getWindowsServiceStateFromUint32(svc.State(status.CurrentState))
+	node.Win32ExitCode = status.Win32ExitCode
+	node.ServiceSpecificExitCode = status.ServiceSpecificExitCode
+	node.CheckPoint = status.CheckPoint
+	node.WaitHint = status.WaitHint
+	node.ProcessId = status.ProcessId
+
+	for _, dep := range cfg.Dependencies {
+		child, err := diagnoseService(m, dep, visited)
+		if err != nil {
+			return node, err
+		}
+		node.Dependencies = append(node.Dependencies, child)
+	}
+	return node, nil
+}
+
 // Get executable path
 func execPath() (string, error) {
 	prog := os.Args[0]
@@ -270,10 +562,19 @@ func getWindowsServiceStateFromUint32(state svc.State) string {
 
 type serviceHandler struct {
 	executable Executable
+	// preShutdownTimeout bounds the optional PreShutdown hook below; it is
+	// copied from the windowsRecord, i.e. the value last passed to
+	// SetPreShutdownTimeout on that Daemon, and is not read back from the
+	// SCM. Zero falls back to defaultStopTimeout.
+	preShutdownTimeout time.Duration
 }
 
 func (sh *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	cmdsAccepted := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	preShutdowner, hasPreShutdown := sh.executable.(PreShutdowner)
+	if hasPreShutdown {
+		cmdsAccepted |= svc.AcceptPreShutdown
+	}
 	changes <- svc.Status{State: svc.StartPending}
 	fasttick := time.Tick(500 * time.Millisecond)
 	slowtick := time.Tick(2 * time.Second)
@@ -307,6 +608,16 @@ loop:
 				sh.executable.Stop()
 				break
 				// break loop
+			case svc.PreShutdown:
+				if hasPreShutdown {
+					timeout := sh.preShutdownTimeout
+					if timeout <= 0 {
+						timeout = defaultStopTimeout
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), timeout)
+					preShutdowner.PreShutdown(ctx)
+					cancel()
+				}
 			case svc.Pause:
 				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
 				tick = slowtick
@@ -336,14 +647,43 @@ func (windows *windowsRecord) Run(e Executable) (string, error) {
 		// service called from windows service manager
 		// use API provided by golang.org/x/sys/windows
 		err = svc.Run(windows.name, &serviceHandler{
-			executable: e,
+			executable:         e,
+			preShutdownTimeout: windows.preShutdownTimeout,
 		})
 		if err != nil {
 			return runAction + failed, getWindowsError(err)
 		}
 	} else {
-		// otherwise, service should be called from terminal session
-		e.Run()
+		// otherwise, service should be called from terminal session; mirror
+		// the SCM-driven lifecycle so a user testing the binary at a console
+		// (or under a debugger) can press Ctrl-C and get a clean Stop()
+		// instead of the process just being killed.
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigCh)
+
+		e.Start()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			e.Run()
+		}()
+
+		select {
+		case <-done:
+			return runAction + " completed.", nil
+		case <-sigCh:
+			e.Stop()
+		}
+
+		grace := windows.stopTimeout
+		if grace <= 0 {
+			grace = defaultStopTimeout
+		}
+		select {
+		case <-done:
+		case <-time.After(grace):
+		}
 	}
 
 	return runAction + " completed.", nil
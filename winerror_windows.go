@@ -0,0 +1,49 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+// winError describes a Windows system/service error in human terms, so
+// getWindowsError can turn a bare exit code into something actionable.
+type winError struct {
+	Title       string
+	Description string
+	Action      string
+}
+
+// WinErrCode maps well-known Windows service-related exit codes to a
+// human-readable explanation. It is not exhaustive; codes that are not
+// present fall back to the original error as returned by the OS.
+var WinErrCode = map[int]winError{
+	1056: {
+		Title:       "ERROR_SERVICE_ALREADY_RUNNING",
+		Description: "An instance of the service is already running.",
+		Action:      "Stop the running instance before starting a new one.",
+	},
+	1060: {
+		Title:       "ERROR_SERVICE_DOES_NOT_EXIST",
+		Description: "The specified service does not exist as an installed service.",
+		Action:      "Install the service before starting, stopping or querying it.",
+	},
+	1061: {
+		Title:       "ERROR_SERVICE_CANNOT_ACCEPT_CTRL",
+		Description: "The service cannot accept control messages at this time.",
+		Action:      "Wait for the service to finish its current state transition and retry.",
+	},
+	1062: {
+		Title:       "ERROR_SERVICE_NOT_ACTIVE",
+		Description: "The service has not been started.",
+		Action:      "Start the service before sending it control requests.",
+	},
+	1072: {
+		Title:       "ERROR_SERVICE_MARKED_FOR_DELETE",
+		Description: "The specified service has already been marked for deletion.",
+		Action:      "Wait for the pending deletion to complete before reinstalling.",
+	},
+	1073: {
+		Title:       "ERROR_SERVICE_EXISTS",
+		Description: "The specified service already exists.",
+		Action:      "Remove the existing service before installing it again.",
+	},
+}